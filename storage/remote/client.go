@@ -0,0 +1,747 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mitchellh/hashstructure"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	config_util "github.com/prometheus/common/config"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/common/version"
+	"golang.org/x/time/rate"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const maxErrMsgLen = 1024
+
+var UserAgent = version.ComponentUserAgent("remote-write")
+
+// RecoverableError is an error that is recoverable by retrying, possibly
+// after waiting retryAfter.
+type RecoverableError struct {
+	error
+	retryAfter model.Duration
+}
+
+// defaultBackoff is used for the retryAfter value when the server does not
+// specify a Retry-After header, or the header cannot be parsed.
+const defaultBackoff = model.Duration(0)
+
+// RetryPolicy configures the in-client retry behaviour for Store(). When
+// left at its zero value, Store() does not retry and instead returns the
+// RecoverableError to the caller, as before.
+type RetryPolicy struct {
+	// MaxRetries is the maximum number of attempts Store() will make,
+	// including the first one. A value <= 1 disables in-client retries.
+	MaxRetries int
+
+	// InitialBackoff is the backoff used before the first retry.
+	InitialBackoff model.Duration
+
+	// MaxBackoff caps the computed backoff between retries.
+	MaxBackoff model.Duration
+
+	// Multiplier is applied to the previous backoff to compute the upper
+	// bound for the next one. Defaults to 2 if unset.
+	Multiplier float64
+
+	// JitterFraction is accepted for configuration compatibility but is
+	// not used: nextBackoff always randomizes over the whole
+	// decorrelated-jitter range [InitialBackoff, prev*Multiplier].
+	JitterFraction float64
+}
+
+func (r RetryPolicy) enabled() bool {
+	return r.MaxRetries > 1
+}
+
+// nextBackoff computes the next decorrelated-jitter backoff given the
+// previous one, honoring a server Retry-After header as a lower bound when
+// present, up to MaxBackoff.
+func (r RetryPolicy) nextBackoff(prev, retryAfter time.Duration) time.Duration {
+	initial := time.Duration(r.InitialBackoff)
+	max := time.Duration(r.MaxBackoff)
+	mult := r.Multiplier
+	if mult <= 1 {
+		mult = 2
+	}
+
+	if prev <= 0 {
+		prev = initial
+	}
+
+	upper := time.Duration(float64(prev) * mult)
+	if upper <= initial {
+		upper = initial + 1
+	}
+
+	next := initial + time.Duration(rand.Int63n(int64(upper-initial)+1))
+	if retryAfter > next {
+		next = retryAfter
+	}
+	// MaxBackoff, when set, caps the computed backoff, Retry-After
+	// included: it is the operator's hard ceiling on how long Store()
+	// will ever sleep between retries. Independently of it, the header
+	// value itself is bounded by retryAfterDuration's own, separately
+	// configurable ceiling (see MaxRetryAfter), which also protects
+	// RecoverableError's retryAfter field for callers that don't use
+	// RetryPolicy at all.
+	if next > max && max > 0 {
+		next = max
+	}
+	return next
+}
+
+// ClientConfig configures a Client.
+type ClientConfig struct {
+	URL              *config_util.URL
+	Timeout          model.Duration
+	HTTPClientConfig config_util.HTTPClientConfig
+	Headers          map[string]string
+
+	// RetryOnRateLimit retries a 429 response the same way a recoverable
+	// 5xx is retried by the WAL-driven caller, instead of treating it as
+	// a permanent failure. It only affects the default RetryClassifier;
+	// it is ignored once RetryClassifier is set explicitly.
+	RetryOnRateLimit bool
+
+	// RetryPolicy, if enabled, makes Store() retry recoverable errors
+	// in-client instead of returning them to the caller immediately.
+	RetryPolicy RetryPolicy
+
+	// RetryClassifier decides whether a response from the endpoint is
+	// recoverable. If nil, a default classifier matching historical
+	// behavior is used: see DefaultRetryClassifier. Excluded from toHash
+	// since hashstructure can't hash func values.
+	RetryClassifier RetryClassifier `hash:"ignore"`
+
+	// RateLimit, if enabled, makes Store() wait on a token-bucket limiter
+	// before issuing its HTTP request. The bucket is shared by every
+	// Client whose ClientConfig hashes the same (see toHash), so that
+	// multiple shards writing to the same endpoint share one budget.
+	RateLimit RateLimit
+
+	// CircuitBreaker, if enabled, makes Store() short-circuit to a
+	// RecoverableError without hitting the network once the endpoint has
+	// failed consistently, instead of paying full DNS/TLS/timeout cost on
+	// every request to an endpoint that is already down.
+	CircuitBreaker CircuitBreaker
+}
+
+// RateLimit configures a token-bucket limiter shared across clients that
+// hash to the same ClientConfig.
+type RateLimit struct {
+	RequestsPerSecond float64
+	Burst             int
+}
+
+func (r RateLimit) enabled() bool {
+	return r.RequestsPerSecond > 0
+}
+
+// sharedLimiters holds one rate.Limiter per distinct ClientConfig hash, so
+// that shards sending to the same endpoint share a single budget instead of
+// each enforcing their own and collectively exceeding it.
+var (
+	sharedLimitersMtx sync.Mutex
+	sharedLimiters    = map[string]*sharedLimiter{}
+)
+
+// sharedLimiter wraps a rate.Limiter so a 429's Retry-After can temporarily
+// tighten it before the configured rate is restored.
+type sharedLimiter struct {
+	mu      sync.Mutex
+	limiter *rate.Limiter
+	base    rate.Limit
+	burst   int
+	restore *time.Timer
+	// gen is bumped on every tightenFor call and captured by that call's
+	// restore callback, so a restore from an older, superseded tighten
+	// can tell it's stale and no-op instead of undoing a tighter,
+	// more recent Retry-After.
+	gen int
+}
+
+// wait blocks until the shared limiter admits one request, or ctx is done.
+func (l *sharedLimiter) wait(ctx context.Context) error {
+	l.mu.Lock()
+	limiter := l.limiter
+	l.mu.Unlock()
+	return limiter.Wait(ctx)
+}
+
+func sharedLimiterFor(hash string, cfg RateLimit) *sharedLimiter {
+	sharedLimitersMtx.Lock()
+	defer sharedLimitersMtx.Unlock()
+
+	if l, ok := sharedLimiters[hash]; ok {
+		return l
+	}
+	limit := rate.Limit(cfg.RequestsPerSecond)
+	l := &sharedLimiter{
+		limiter: rate.NewLimiter(limit, cfg.Burst),
+		base:    limit,
+		burst:   cfg.Burst,
+	}
+	sharedLimiters[hash] = l
+	return l
+}
+
+// tightenFor reduces the limiter to one request per retryAfter for that
+// long, then restores the configured rate. It rebuilds the underlying
+// rate.Limiter rather than just calling SetLimit/SetBurst, since those
+// leave any tokens already accumulated under the prior, looser rate
+// sitting in the bucket: a Store() with burst slack left would otherwise
+// sail straight through a "tightened" limiter.
+func (l *sharedLimiter) tightenFor(retryAfter time.Duration) {
+	if retryAfter <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.limiter = rate.NewLimiter(rate.Every(retryAfter), 1)
+	// A new rate.Limiter starts with a full bucket; take its one token so
+	// the next request waits out retryAfter instead of going straight
+	// through.
+	l.limiter.Allow()
+
+	if l.restore != nil {
+		l.restore.Stop()
+	}
+	l.gen++
+	gen := l.gen
+	l.restore = time.AfterFunc(retryAfter, func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		// Stop() above can't prevent an already-fired timer's goroutine
+		// from being in flight; if a newer tightenFor raced ahead of us
+		// and bumped gen, our restore is stale and must not clobber it.
+		if l.gen != gen {
+			return
+		}
+		l.limiter = rate.NewLimiter(l.base, l.burst)
+	})
+}
+
+// CircuitBreaker configures an optional circuit breaker around Store().
+type CircuitBreaker struct {
+	// FailureThreshold is the number of consecutive recoverable failures
+	// that trips the breaker open.
+	FailureThreshold int
+
+	// FailureWindow bounds how long a run of failures may span and still
+	// count as consecutive; a failure following a gap longer than this
+	// restarts the count at one instead of adding to the streak.
+	FailureWindow model.Duration
+
+	// OpenDuration is how long the breaker stays open before admitting
+	// half-open probes.
+	OpenDuration model.Duration
+
+	// HalfOpenProbes is the number of requests admitted while half-open
+	// before the breaker fully closes (on success) or reopens (on
+	// failure). Defaults to 1 if unset, the same way RetryPolicy.Multiplier
+	// defaults to 2: left at zero, the breaker would never admit a probe
+	// and stay wedged half-open forever.
+	HalfOpenProbes int
+}
+
+func (cb CircuitBreaker) enabled() bool {
+	return cb.FailureThreshold > 0
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half_open"
+	default:
+		return "closed"
+	}
+}
+
+var circuitBreakerTransitionsTotal = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "prometheus",
+		Subsystem: "remote_storage",
+		Name:      "circuitbreaker_transitions_total",
+		Help:      "Number of circuit breaker state transitions for a remote write endpoint.",
+	},
+	[]string{"remote_name", "url", "state"},
+)
+
+var circuitBreakerState = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "prometheus",
+		Subsystem: "remote_storage",
+		Name:      "circuitbreaker_state",
+		Help:      "Current circuit breaker state for a remote write endpoint (0=closed, 1=open, 2=half_open).",
+	},
+	[]string{"remote_name", "url"},
+)
+
+// errCircuitOpen is returned, wrapped in a RecoverableError, while the
+// circuit breaker is open.
+var errCircuitOpen = errors.New("circuit breaker is open")
+
+// circuitBreaker trips on a run of consecutive recoverable failures and
+// sheds load on the endpoint until it has had OpenDuration to recover.
+type circuitBreaker struct {
+	cfg CircuitBreaker
+
+	transitions *prometheus.CounterVec
+	state       *prometheus.GaugeVec
+
+	mu                  sync.Mutex
+	current             breakerState
+	consecutiveFailures int
+	lastFailure         time.Time
+	openUntil           time.Time
+	halfOpenInFlight    int
+}
+
+func newCircuitBreaker(cfg CircuitBreaker, remoteName, url string) *circuitBreaker {
+	if cfg.HalfOpenProbes <= 0 {
+		cfg.HalfOpenProbes = 1
+	}
+	return &circuitBreaker{
+		cfg:         cfg,
+		transitions: circuitBreakerTransitionsTotal.MustCurryWith(prometheus.Labels{"remote_name": remoteName, "url": url}),
+		state:       circuitBreakerState.MustCurryWith(prometheus.Labels{"remote_name": remoteName, "url": url}),
+	}
+}
+
+// before is consulted at the start of every Store() attempt. If it returns
+// allow=false, the caller must not hit the network and should instead
+// return RecoverableError{..., retryAfter}.
+func (b *circuitBreaker) before() (allow bool, retryAfter time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if b.current == breakerOpen {
+		if now.Before(b.openUntil) {
+			return false, time.Until(b.openUntil)
+		}
+		b.setState(breakerHalfOpen)
+		b.halfOpenInFlight = 0
+	}
+
+	if b.current == breakerHalfOpen {
+		if b.halfOpenInFlight >= b.cfg.HalfOpenProbes {
+			return false, time.Until(b.openUntil)
+		}
+		b.halfOpenInFlight++
+	}
+	return true, 0
+}
+
+// abort releases a slot admitted by before() without recording an outcome,
+// for attempts that never reached the network (e.g. the caller's context
+// was already done, or the rate limiter wait was cancelled) and so say
+// nothing about whether the endpoint itself is healthy.
+func (b *circuitBreaker) abort() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.current == breakerHalfOpen {
+		b.halfOpenInFlight--
+	}
+}
+
+// after records the outcome of an attempt that before() admitted.
+func (b *circuitBreaker) after(success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.current {
+	case breakerHalfOpen:
+		b.halfOpenInFlight--
+		if success {
+			b.setState(breakerClosed)
+			b.consecutiveFailures = 0
+		} else {
+			b.trip()
+		}
+	default:
+		if success {
+			b.consecutiveFailures = 0
+			return
+		}
+		now := time.Now()
+		if window := time.Duration(b.cfg.FailureWindow); window > 0 && !b.lastFailure.IsZero() && now.Sub(b.lastFailure) > window {
+			b.consecutiveFailures = 0
+		}
+		b.lastFailure = now
+		b.consecutiveFailures++
+		if b.consecutiveFailures >= b.cfg.FailureThreshold {
+			b.trip()
+		}
+	}
+}
+
+func (b *circuitBreaker) trip() {
+	b.openUntil = time.Now().Add(time.Duration(b.cfg.OpenDuration))
+	b.consecutiveFailures = 0
+	b.setState(breakerOpen)
+}
+
+func (b *circuitBreaker) setState(s breakerState) {
+	if b.current == s {
+		return
+	}
+	b.current = s
+	b.transitions.WithLabelValues(s.String()).Inc()
+	b.state.WithLabelValues().Set(float64(s))
+}
+
+// RetryClassifier decides whether an attempt made by Store() should be
+// treated as recoverable, and how long to back off before the next one.
+// resp is nil when err came from a transport-level failure (e.g. the
+// endpoint was unreachable) rather than from a completed HTTP response.
+type RetryClassifier func(resp *http.Response, err error) (retry bool, backoff time.Duration)
+
+// DefaultRetryClassifier reproduces Store()'s original hard-coded behavior:
+// 5xx is always recoverable, 429 is recoverable only when retryOnRateLimit
+// is set, and every other status is permanent.
+func DefaultRetryClassifier(retryOnRateLimit bool) RetryClassifier {
+	return func(resp *http.Response, _ error) (bool, time.Duration) {
+		if resp == nil {
+			return true, 0
+		}
+		if resp.StatusCode/100 == 5 || (retryOnRateLimit && resp.StatusCode == http.StatusTooManyRequests) {
+			return true, time.Duration(retryAfterDuration(resp.Header.Get("Retry-After")))
+		}
+		return false, 0
+	}
+}
+
+// StrictRetryClassifier only retries 5xx responses and transport-level
+// errors; 429 and all other 4xx are treated as permanent failures.
+func StrictRetryClassifier(resp *http.Response, _ error) (bool, time.Duration) {
+	if resp == nil {
+		return true, 0
+	}
+	if resp.StatusCode/100 == 5 {
+		return true, time.Duration(retryAfterDuration(resp.Header.Get("Retry-After")))
+	}
+	return false, 0
+}
+
+// LenientRetryClassifier retries 5xx and 429 and additionally 400 and 409,
+// which some receivers (e.g. Cortex, Mimir) use for transient ingester
+// overload or soft-rejects that clear on retry.
+func LenientRetryClassifier(resp *http.Response, _ error) (bool, time.Duration) {
+	if resp == nil {
+		return true, 0
+	}
+	switch resp.StatusCode {
+	case http.StatusBadRequest, http.StatusTooManyRequests, http.StatusConflict:
+	default:
+		if resp.StatusCode/100 != 5 {
+			return false, 0
+		}
+	}
+	return true, time.Duration(retryAfterDuration(resp.Header.Get("Retry-After")))
+}
+
+// OTLPStyleRetryClassifier mirrors the OTLP exporter's retryable set: 429,
+// 502, 503 and 504 are recoverable; every other status, including other
+// 5xx, is permanent.
+func OTLPStyleRetryClassifier(resp *http.Response, _ error) (bool, time.Duration) {
+	if resp == nil {
+		return true, 0
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true, time.Duration(retryAfterDuration(resp.Header.Get("Retry-After")))
+	default:
+		return false, 0
+	}
+}
+
+// ReadClient uses the SAMPLES method of remote read to read series samples
+// from remote endpoint.
+type ReadClient interface {
+	Read(ctx context.Context, query *prompb.Query) (*prompb.QueryResult, error)
+}
+
+// WriteClient defines an interface for sending a batch of samples to a
+// remote destination.
+type WriteClient interface {
+	Store(ctx context.Context, req []byte) error
+	Name() string
+	Endpoint() string
+}
+
+// Client allows reading and writing from/to a remote HTTP endpoint.
+type Client struct {
+	remoteName string
+	urlString  string
+	Client     *http.Client
+	timeout    time.Duration
+
+	retryPolicy     RetryPolicy
+	retryClassifier RetryClassifier
+	rateLimiter     *sharedLimiter
+	breaker         *circuitBreaker
+}
+
+// NewWriteClient creates a new client for remote write.
+func NewWriteClient(name string, conf *ClientConfig) (WriteClient, error) {
+	httpClient, err := config_util.NewClientFromConfig(conf.HTTPClientConfig, "remote_storage_write_client")
+	if err != nil {
+		return nil, err
+	}
+
+	retryClassifier := conf.RetryClassifier
+	if retryClassifier == nil {
+		retryClassifier = DefaultRetryClassifier(conf.RetryOnRateLimit)
+	}
+
+	var limiter *sharedLimiter
+	if conf.RateLimit.enabled() {
+		hash, err := toHash(conf)
+		if err != nil {
+			return nil, err
+		}
+		limiter = sharedLimiterFor(hash, conf.RateLimit)
+	}
+
+	var breaker *circuitBreaker
+	if conf.CircuitBreaker.enabled() {
+		breaker = newCircuitBreaker(conf.CircuitBreaker, name, conf.URL.String())
+	}
+
+	return &Client{
+		remoteName:      name,
+		urlString:       conf.URL.String(),
+		Client:          httpClient,
+		timeout:         time.Duration(conf.Timeout),
+		retryPolicy:     conf.RetryPolicy,
+		retryClassifier: retryClassifier,
+		rateLimiter:     limiter,
+		breaker:         breaker,
+	}, nil
+}
+
+// toHash returns a hash identifying the given ClientConfig, used to
+// deduplicate clients that share the same endpoint and configuration.
+func toHash(conf *ClientConfig) (string, error) {
+	hash, err := hashstructure.Hash(conf, nil)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%016x", hash), nil
+}
+
+// Name returns the name of the client, as parsed from its config.
+func (c *Client) Name() string {
+	return c.remoteName
+}
+
+// Endpoint returns the URL this client is writing to.
+func (c *Client) Endpoint() string {
+	return c.urlString
+}
+
+// Store sends a batch of samples to the HTTP endpoint, the request is the
+// proto marshalled and compressed bytes from codec.go. It retries
+// in-client when c.retryPolicy is enabled, otherwise it hands the
+// RecoverableError back to the caller unchanged, as before.
+func (c *Client) Store(ctx context.Context, req []byte) error {
+	if !c.retryPolicy.enabled() {
+		return c.storeOnce(ctx, req)
+	}
+
+	var (
+		err     error
+		backoff time.Duration
+	)
+	for attempt := 0; attempt < c.retryPolicy.MaxRetries; attempt++ {
+		err = c.storeOnce(ctx, req)
+		if err == nil {
+			return nil
+		}
+
+		var recErr RecoverableError
+		if !errors.As(err, &recErr) {
+			return err
+		}
+
+		if attempt == c.retryPolicy.MaxRetries-1 {
+			return err
+		}
+
+		backoff = c.retryPolicy.nextBackoff(backoff, time.Duration(recErr.retryAfter))
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+	}
+	return err
+}
+
+func (c *Client) storeOnce(ctx context.Context, req []byte) error {
+	var (
+		attempted bool
+		success   bool
+	)
+	if c.breaker != nil {
+		allow, retryAfter := c.breaker.before()
+		if !allow {
+			return RecoverableError{errCircuitOpen, model.Duration(retryAfter)}
+		}
+		// before() may have admitted this as a half-open probe; release
+		// the slot on every exit path below, not just the ones that used
+		// to call after() explicitly. Exit paths that never attempted the
+		// network (rate limiter wait cancelled, request build failed)
+		// call abort() instead of after(): they say nothing about whether
+		// the endpoint is healthy and must not be recorded as a failure.
+		defer func() {
+			if attempted {
+				c.breaker.after(success)
+			} else {
+				c.breaker.abort()
+			}
+		}()
+	}
+
+	// Create the per-attempt timeout context before the rate limiter wait,
+	// not just around the HTTP request, so a tightened limiter (see
+	// sharedLimiter.tightenFor) can't block an attempt past the
+	// configured Timeout when the caller passed in a context with no
+	// deadline of its own.
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	if c.rateLimiter != nil {
+		if err := c.rateLimiter.wait(ctx); err != nil {
+			return err
+		}
+	}
+
+	httpReq, err := http.NewRequest("POST", c.urlString, bytes.NewReader(req))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Add("Content-Encoding", "snappy")
+	httpReq.Header.Set("Content-Type", "application/x-protobuf")
+	httpReq.Header.Set("User-Agent", UserAgent)
+	httpReq.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	httpReq = httpReq.WithContext(ctx)
+
+	attempted = true
+	httpResp, err := c.Client.Do(httpReq)
+	if err != nil {
+		retry, backoff := c.retryClassifier(nil, err)
+		success = !retry
+		if retry {
+			return RecoverableError{err, model.Duration(backoff)}
+		}
+		return err
+	}
+	defer func() {
+		io.Copy(ioutil.Discard, httpResp.Body)
+		httpResp.Body.Close()
+	}()
+
+	if httpResp.StatusCode/100 != 2 {
+		scanner := bufio.NewScanner(io.LimitReader(httpResp.Body, maxErrMsgLen))
+		line := ""
+		if scanner.Scan() {
+			line = scanner.Text()
+		}
+		err = fmt.Errorf("server returned HTTP status %s: %s", httpResp.Status, line)
+	}
+
+	if c.rateLimiter != nil && httpResp.StatusCode == http.StatusTooManyRequests {
+		c.rateLimiter.tightenFor(time.Duration(retryAfterDuration(httpResp.Header.Get("Retry-After"))))
+	}
+
+	retry, backoff := c.retryClassifier(httpResp, err)
+	success = err == nil || !retry
+	if retry {
+		return RecoverableError{err, model.Duration(backoff)}
+	}
+	return err
+}
+
+// MaxRetryAfter caps the duration retryAfterDuration can return, however
+// the header was formatted, so that a clock-skewed or malicious server
+// can't stall a sender for an unbounded amount of time: the delta-seconds
+// form has no upper bound of its own, and an HTTP-date far enough in the
+// future is just as unbounded. It is a package variable, in the same spirit
+// as UserAgent, for operators who need a different ceiling than the
+// default.
+var MaxRetryAfter = time.Hour
+
+// retryAfterDuration returns the time to wait before retrying, given the
+// value of a Retry-After header, clamped to [0, MaxRetryAfter]. It accepts
+// both the delta-seconds form (e.g. "120") and the HTTP-date form allowed
+// by RFC 7231 (e.g. "Wed, 21 Oct 2015 07:28:00 GMT"), falling back to
+// defaultBackoff if t is empty or in neither format.
+func retryAfterDuration(t string) model.Duration {
+	if parsedDuration, err := strconv.Atoi(t); err == nil {
+		return model.Duration(clampRetryAfter(time.Duration(parsedDuration) * time.Second))
+	}
+
+	for _, layout := range []string{http.TimeFormat, time.RFC1123} {
+		target, err := time.Parse(layout, t)
+		if err != nil {
+			continue
+		}
+		return model.Duration(clampRetryAfter(time.Until(target)))
+	}
+
+	return defaultBackoff
+}
+
+func clampRetryAfter(d time.Duration) time.Duration {
+	if d < 0 {
+		return 0
+	}
+	if d > MaxRetryAfter {
+		return MaxRetryAfter
+	}
+	return d
+}
@@ -20,12 +20,15 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	config_util "github.com/prometheus/common/config"
 	"github.com/prometheus/common/model"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
 )
 
 var longErrMessage = strings.Repeat("error message", maxErrMsgLen)
@@ -132,6 +135,494 @@ func TestClientRetryAfter(t *testing.T) {
 	checkStoreError(getClient(getClientConfig(true)), true, 5*model.Duration(time.Second))
 }
 
+func TestRetryClassifiers(t *testing.T) {
+	tests := []struct {
+		name        string
+		classifier  RetryClassifier
+		code        int
+		wantRecover bool
+	}{
+		{"default 429 permanent", DefaultRetryClassifier(false), http.StatusTooManyRequests, false},
+		{"default 429 recoverable when enabled", DefaultRetryClassifier(true), http.StatusTooManyRequests, true},
+		{"default 500 recoverable", DefaultRetryClassifier(false), http.StatusInternalServerError, true},
+		{"default 400 permanent", DefaultRetryClassifier(false), http.StatusBadRequest, false},
+
+		{"strict 500 recoverable", StrictRetryClassifier, http.StatusInternalServerError, true},
+		{"strict 429 permanent", StrictRetryClassifier, http.StatusTooManyRequests, false},
+		{"strict 400 permanent", StrictRetryClassifier, http.StatusBadRequest, false},
+
+		{"lenient 400 recoverable", LenientRetryClassifier, http.StatusBadRequest, true},
+		{"lenient 409 recoverable", LenientRetryClassifier, http.StatusConflict, true},
+		{"lenient 429 recoverable", LenientRetryClassifier, http.StatusTooManyRequests, true},
+		{"lenient 500 recoverable", LenientRetryClassifier, http.StatusInternalServerError, true},
+		{"lenient 404 permanent", LenientRetryClassifier, http.StatusNotFound, false},
+
+		{"otlp 429 recoverable", OTLPStyleRetryClassifier, http.StatusTooManyRequests, true},
+		{"otlp 503 recoverable", OTLPStyleRetryClassifier, http.StatusServiceUnavailable, true},
+		{"otlp 500 permanent", OTLPStyleRetryClassifier, http.StatusInternalServerError, false},
+		{"otlp 400 permanent", OTLPStyleRetryClassifier, http.StatusBadRequest, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					http.Error(w, longErrMessage, test.code)
+				}),
+			)
+			defer server.Close()
+
+			serverURL, err := url.Parse(server.URL)
+			require.NoError(t, err)
+
+			conf := &ClientConfig{
+				URL:             &config_util.URL{URL: serverURL},
+				Timeout:         model.Duration(time.Second),
+				RetryClassifier: test.classifier,
+			}
+
+			hash, err := toHash(conf)
+			require.NoError(t, err)
+			c, err := NewWriteClient(hash, conf)
+			require.NoError(t, err)
+
+			var recErr RecoverableError
+			err = c.Store(context.Background(), []byte{})
+			require.Equal(t, test.wantRecover, errors.As(err, &recErr))
+		})
+	}
+}
+
+func TestRetryPolicyNextBackoff(t *testing.T) {
+	t.Run("Retry-After above MaxBackoff is clamped to MaxBackoff", func(t *testing.T) {
+		r := RetryPolicy{
+			InitialBackoff: model.Duration(time.Second),
+			MaxBackoff:     model.Duration(5 * time.Second),
+			Multiplier:     2,
+		}
+
+		next := r.nextBackoff(0, 30*time.Second)
+		require.Equal(t, 5*time.Second, next)
+	})
+}
+
+func TestClientRetryPolicy(t *testing.T) {
+	t.Run("retries until success", func(t *testing.T) {
+		var attempts int32
+		server := httptest.NewServer(
+			http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := atomic.AddInt32(&attempts, 1)
+				if n < 3 {
+					w.Header().Set("Retry-After", "0")
+					http.Error(w, longErrMessage, http.StatusServiceUnavailable)
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+			}),
+		)
+		defer server.Close()
+
+		serverURL, err := url.Parse(server.URL)
+		require.NoError(t, err)
+
+		conf := &ClientConfig{
+			URL:     &config_util.URL{URL: serverURL},
+			Timeout: model.Duration(time.Second),
+			RetryPolicy: RetryPolicy{
+				MaxRetries:     5,
+				InitialBackoff: model.Duration(time.Millisecond),
+				MaxBackoff:     model.Duration(10 * time.Millisecond),
+				Multiplier:     2,
+			},
+		}
+
+		hash, err := toHash(conf)
+		require.NoError(t, err)
+		c, err := NewWriteClient(hash, conf)
+		require.NoError(t, err)
+
+		require.NoError(t, c.Store(context.Background(), []byte{}))
+		require.EqualValues(t, 3, atomic.LoadInt32(&attempts))
+	})
+
+	t.Run("gives up after MaxRetries attempts", func(t *testing.T) {
+		var attempts int32
+		server := httptest.NewServer(
+			http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&attempts, 1)
+				http.Error(w, longErrMessage, http.StatusServiceUnavailable)
+			}),
+		)
+		defer server.Close()
+
+		serverURL, err := url.Parse(server.URL)
+		require.NoError(t, err)
+
+		conf := &ClientConfig{
+			URL:     &config_util.URL{URL: serverURL},
+			Timeout: model.Duration(time.Second),
+			RetryPolicy: RetryPolicy{
+				MaxRetries:     3,
+				InitialBackoff: model.Duration(time.Millisecond),
+				MaxBackoff:     model.Duration(5 * time.Millisecond),
+				Multiplier:     2,
+			},
+		}
+
+		hash, err := toHash(conf)
+		require.NoError(t, err)
+		c, err := NewWriteClient(hash, conf)
+		require.NoError(t, err)
+
+		var recErr RecoverableError
+		err = c.Store(context.Background(), []byte{})
+		require.True(t, errors.As(err, &recErr))
+		require.EqualValues(t, 3, atomic.LoadInt32(&attempts))
+	})
+
+	t.Run("aborts immediately on context cancellation", func(t *testing.T) {
+		var attempts int32
+		server := httptest.NewServer(
+			http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&attempts, 1)
+				http.Error(w, longErrMessage, http.StatusServiceUnavailable)
+			}),
+		)
+		defer server.Close()
+
+		serverURL, err := url.Parse(server.URL)
+		require.NoError(t, err)
+
+		conf := &ClientConfig{
+			URL:     &config_util.URL{URL: serverURL},
+			Timeout: model.Duration(time.Second),
+			RetryPolicy: RetryPolicy{
+				MaxRetries:     10,
+				InitialBackoff: model.Duration(time.Second),
+				MaxBackoff:     model.Duration(time.Second),
+				Multiplier:     2,
+			},
+		}
+
+		hash, err := toHash(conf)
+		require.NoError(t, err)
+		c, err := NewWriteClient(hash, conf)
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			cancel()
+		}()
+
+		start := time.Now()
+		err = c.Store(ctx, []byte{})
+		require.Equal(t, context.Canceled, err)
+		require.Less(t, time.Since(start), time.Second)
+	})
+}
+
+func TestClientRateLimit(t *testing.T) {
+	t.Run("shared across clients with the same toHash", func(t *testing.T) {
+		var requests int32
+		server := httptest.NewServer(
+			http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&requests, 1)
+				w.WriteHeader(http.StatusOK)
+			}),
+		)
+		defer server.Close()
+
+		serverURL, err := url.Parse(server.URL)
+		require.NoError(t, err)
+
+		conf := &ClientConfig{
+			URL: &config_util.URL{URL: serverURL},
+			// Timeout also bounds the rate limiter wait, so it must leave
+			// room for the ~1s refill plus the request itself.
+			Timeout:   model.Duration(5 * time.Second),
+			RateLimit: RateLimit{RequestsPerSecond: 1, Burst: 1},
+		}
+
+		hash, err := toHash(conf)
+		require.NoError(t, err)
+
+		c1, err := NewWriteClient(hash, conf)
+		require.NoError(t, err)
+		c2, err := NewWriteClient(hash, conf)
+		require.NoError(t, err)
+
+		// The burst of 1 is shared: the first Store from either client
+		// consumes it, so a second immediate call from the other client
+		// must wait roughly 1s for the bucket to refill.
+		require.NoError(t, c1.Store(context.Background(), []byte{}))
+
+		start := time.Now()
+		require.NoError(t, c2.Store(context.Background(), []byte{}))
+		require.GreaterOrEqual(t, time.Since(start), 500*time.Millisecond)
+		require.EqualValues(t, 2, atomic.LoadInt32(&requests))
+	})
+
+	t.Run("Retry-After transiently tightens the limiter", func(t *testing.T) {
+		server := httptest.NewServer(
+			http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, longErrMessage, http.StatusTooManyRequests)
+			}),
+		)
+		defer server.Close()
+
+		serverURL, err := url.Parse(server.URL)
+		require.NoError(t, err)
+
+		conf := &ClientConfig{
+			URL:       &config_util.URL{URL: serverURL},
+			Timeout:   model.Duration(time.Second),
+			RateLimit: RateLimit{RequestsPerSecond: 100, Burst: 10},
+		}
+
+		hash, err := toHash(conf)
+		require.NoError(t, err)
+		c, err := NewWriteClient(hash, conf)
+		require.NoError(t, err)
+
+		// First attempt gets the 429 and tightens the shared limiter to
+		// ~1 req/s for the next second.
+		require.Error(t, c.Store(context.Background(), []byte{}))
+
+		start := time.Now()
+		require.Error(t, c.Store(context.Background(), []byte{}))
+		require.GreaterOrEqual(t, time.Since(start), 500*time.Millisecond)
+	})
+
+	t.Run("rate limiter wait is bounded by Timeout, not just the caller context", func(t *testing.T) {
+		server := httptest.NewServer(
+			http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}),
+		)
+		defer server.Close()
+
+		serverURL, err := url.Parse(server.URL)
+		require.NoError(t, err)
+
+		conf := &ClientConfig{
+			URL:       &config_util.URL{URL: serverURL},
+			Timeout:   model.Duration(50 * time.Millisecond),
+			RateLimit: RateLimit{RequestsPerSecond: 1, Burst: 1},
+		}
+
+		hash, err := toHash(conf)
+		require.NoError(t, err)
+		c, err := NewWriteClient(hash, conf)
+		require.NoError(t, err)
+
+		// Consume the single burst token, then make a second call with a
+		// background (deadline-less) context. Without the fix the limiter
+		// wait would block for ~1s for the bucket to refill; the
+		// configured Timeout must cut it short instead.
+		require.NoError(t, c.Store(context.Background(), []byte{}))
+
+		start := time.Now()
+		err = c.Store(context.Background(), []byte{})
+		require.Error(t, err)
+		require.Less(t, time.Since(start), 500*time.Millisecond)
+	})
+}
+
+func TestSharedLimiterTightenForStaleRestore(t *testing.T) {
+	l := sharedLimiterFor(t.Name(), RateLimit{RequestsPerSecond: 100, Burst: 1})
+
+	// Schedule a short tighten whose restore would fire mid-way through a
+	// second, longer tighten started right after it. The first tighten's
+	// restore must not reset the limiter back to the base rate while the
+	// second tighten is still in effect: the second call stops the first
+	// timer, and the gen guard covers a restore callback that had already
+	// fired.
+	l.tightenFor(40 * time.Millisecond)
+	l.tightenFor(200 * time.Millisecond)
+
+	time.Sleep(80 * time.Millisecond)
+
+	l.mu.Lock()
+	limit := l.limiter.Limit()
+	l.mu.Unlock()
+	require.NotEqual(t, rate.Limit(100), limit, "stale restore from the superseded tighten reset the limiter early")
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		code = http.StatusInternalServerError
+	)
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			c := code
+			mu.Unlock()
+			if c == http.StatusOK {
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+			http.Error(w, longErrMessage, c)
+		}),
+	)
+	defer server.Close()
+
+	setCode := func(c int) {
+		mu.Lock()
+		defer mu.Unlock()
+		code = c
+	}
+
+	serverURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+
+	conf := &ClientConfig{
+		URL:     &config_util.URL{URL: serverURL},
+		Timeout: model.Duration(time.Second),
+		CircuitBreaker: CircuitBreaker{
+			FailureThreshold: 2,
+			FailureWindow:    model.Duration(time.Minute),
+			OpenDuration:     model.Duration(50 * time.Millisecond),
+			HalfOpenProbes:   1,
+		},
+	}
+
+	hash, err := toHash(conf)
+	require.NoError(t, err)
+	c, err := NewWriteClient(hash, conf)
+	require.NoError(t, err)
+	cc := c.(*Client)
+
+	// closed: two consecutive 500s trip the breaker open.
+	require.Error(t, c.Store(context.Background(), []byte{}))
+	require.Equal(t, breakerClosed, cc.breaker.current)
+	require.Error(t, c.Store(context.Background(), []byte{}))
+	require.Equal(t, breakerOpen, cc.breaker.current)
+
+	// open: Store() short-circuits without hitting the network.
+	var recErr RecoverableError
+	err = c.Store(context.Background(), []byte{})
+	require.True(t, errors.As(err, &recErr))
+	require.Equal(t, errCircuitOpen, recErr.error)
+
+	// half-open: after OpenDuration, a successful probe closes the breaker.
+	time.Sleep(60 * time.Millisecond)
+	setCode(http.StatusOK)
+	require.NoError(t, c.Store(context.Background(), []byte{}))
+	require.Equal(t, breakerClosed, cc.breaker.current)
+
+	// re-trip, then verify a failed half-open probe reopens the breaker.
+	setCode(http.StatusInternalServerError)
+	require.Error(t, c.Store(context.Background(), []byte{}))
+	require.Error(t, c.Store(context.Background(), []byte{}))
+	require.Equal(t, breakerOpen, cc.breaker.current)
+
+	time.Sleep(60 * time.Millisecond)
+	require.Error(t, c.Store(context.Background(), []byte{}))
+	require.Equal(t, breakerOpen, cc.breaker.current)
+}
+
+func TestCircuitBreakerDefaultsHalfOpenProbes(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		code = http.StatusInternalServerError
+	)
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			c := code
+			mu.Unlock()
+			if c == http.StatusOK {
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+			http.Error(w, longErrMessage, c)
+		}),
+	)
+	defer server.Close()
+
+	serverURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+
+	conf := &ClientConfig{
+		URL:     &config_util.URL{URL: serverURL},
+		Timeout: model.Duration(time.Second),
+		CircuitBreaker: CircuitBreaker{
+			FailureThreshold: 2,
+			OpenDuration:     model.Duration(50 * time.Millisecond),
+			// HalfOpenProbes deliberately left unset: it must default to
+			// 1 rather than leaving the breaker permanently wedged
+			// half-open (0 admitted probes forever).
+		},
+	}
+
+	hash, err := toHash(conf)
+	require.NoError(t, err)
+	c, err := NewWriteClient(hash, conf)
+	require.NoError(t, err)
+	cc := c.(*Client)
+
+	require.Error(t, c.Store(context.Background(), []byte{}))
+	require.Error(t, c.Store(context.Background(), []byte{}))
+	require.Equal(t, breakerOpen, cc.breaker.current)
+
+	time.Sleep(60 * time.Millisecond)
+	mu.Lock()
+	code = http.StatusOK
+	mu.Unlock()
+	require.NoError(t, c.Store(context.Background(), []byte{}))
+	require.Equal(t, breakerClosed, cc.breaker.current)
+}
+
+func TestCircuitBreakerIgnoresAbortedAttempts(t *testing.T) {
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}),
+	)
+	defer server.Close()
+
+	serverURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+
+	conf := &ClientConfig{
+		URL:     &config_util.URL{URL: serverURL},
+		Timeout: model.Duration(time.Second),
+		RateLimit: RateLimit{
+			RequestsPerSecond: 1,
+			Burst:             1,
+		},
+		CircuitBreaker: CircuitBreaker{
+			FailureThreshold: 1,
+			OpenDuration:     model.Duration(time.Minute),
+			HalfOpenProbes:   1,
+		},
+	}
+
+	hash, err := toHash(conf)
+	require.NoError(t, err)
+	c, err := NewWriteClient(hash, conf)
+	require.NoError(t, err)
+	cc := c.(*Client)
+
+	// An already-canceled context makes the rate-limiter wait fail before
+	// the request ever reaches the network. With FailureThreshold 1, a
+	// single such abort being recorded as a failure would be enough to
+	// trip the breaker; it must not be.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for i := 0; i < 3; i++ {
+		require.Error(t, cc.Store(ctx, []byte{}))
+		require.Equal(t, breakerClosed, cc.breaker.current)
+	}
+
+	// The endpoint is healthy, so a real attempt still succeeds.
+	require.NoError(t, c.Store(context.Background(), []byte{}))
+	require.Equal(t, breakerClosed, cc.breaker.current)
+}
+
 func TestRetryAfterDuration(t *testing.T) {
 	tc := []struct {
 		name     string
@@ -153,8 +644,43 @@ func TestRetryAfterDuration(t *testing.T) {
 			tInput:   "", // Expected layout is http.TimeFormat, hence an error.
 			expected: defaultBackoff,
 		},
+		{
+			name:     "malformed http-date",
+			tInput:   "not a date",
+			expected: defaultBackoff,
+		},
+		{
+			name:     "http-date in the past",
+			tInput:   time.Now().Add(-time.Hour).Format(http.TimeFormat),
+			expected: 0,
+		},
 	}
 	for _, c := range tc {
 		require.Equal(t, c.expected, retryAfterDuration(c.tInput), c.name)
 	}
+
+	t.Run("http-date in the near future", func(t *testing.T) {
+		target := time.Now().Add(30 * time.Second)
+		got := retryAfterDuration(target.Format(http.TimeFormat))
+		require.InDelta(t, 30, time.Duration(got).Seconds(), 2, "expected ~30s until the target time")
+	})
+
+	t.Run("http-date far in the future is clamped", func(t *testing.T) {
+		target := time.Now().Add(24 * time.Hour)
+		got := retryAfterDuration(target.Format(http.TimeFormat))
+		require.Equal(t, model.Duration(MaxRetryAfter), got)
+	})
+
+	t.Run("delta-seconds is clamped to MaxRetryAfter too", func(t *testing.T) {
+		got := retryAfterDuration("999999999")
+		require.Equal(t, model.Duration(MaxRetryAfter), got)
+	})
+
+	t.Run("MaxRetryAfter is configurable", func(t *testing.T) {
+		old := MaxRetryAfter
+		MaxRetryAfter = time.Minute
+		defer func() { MaxRetryAfter = old }()
+
+		require.Equal(t, model.Duration(time.Minute), retryAfterDuration("7200"))
+	})
 }